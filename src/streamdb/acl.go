@@ -0,0 +1,343 @@
+package streamdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"streamdb/users"
+)
+
+// Op is one operation an ACL entry can grant on a path.
+type Op string
+
+const (
+	Read    Op = "read"
+	Write   Op = "write"
+	Admin   Op = "admin"
+	Resolve Op = "resolve"
+	Debug   Op = "debug"
+)
+
+// ACL maps a tag (the name of a permission tier, e.g. "root", "user",
+// "family", "device", "enabled") to the operations it grants on whatever
+// path the ACL is attached to.
+type ACL map[string][]Op
+
+// Grants reports whether tag is present in the ACL and grants op.
+func (a ACL) Grants(tag string, op Op) bool {
+	for _, granted := range a[tag] {
+		if granted == op {
+			return true
+		}
+	}
+	return false
+}
+
+// tagOrder lists the ACL tags from least to most privileged, mirroring the
+// users.PermissionLevel tiers: a device that qualifies for a tag also
+// qualifies for every tag before it in this slice.
+var tagOrder = []string{"negative", "enabled", "device", "family", "user", "root"}
+
+// qualifyingTags returns tag and every tag below it in privilege.
+func qualifyingTags(tag string) []string {
+	for i, t := range tagOrder {
+		if t == tag {
+			return tagOrder[:i+1]
+		}
+	}
+	return nil
+}
+
+// tagForLevel converts a users.PermissionLevel into the ACL tag it
+// corresponds to.
+func tagForLevel(level users.PermissionLevel) string {
+	switch {
+	case level.Gte(users.ROOT):
+		return "root"
+	case level.Gte(users.USER):
+		return "user"
+	case level.Gte(users.FAMILY):
+		return "family"
+	case level.Gte(users.DEVICE):
+		return "device"
+	case level.Gte(users.ENABLED):
+		return "enabled"
+	default:
+		return "negative"
+	}
+}
+
+var (
+	// ErrNoACL is returned by ACLStore.Get when no ACL is set at path.
+	ErrNoACL = errors.New("No ACL is set for the given path")
+	// ErrBadACLSignature is returned when an on-disk ACL's signature does
+	// not match its contents - the file may have been tampered with.
+	ErrBadACLSignature = errors.New("ACL signature does not match its contents - the file may have been tampered with")
+)
+
+// aclRecord is the signed portion of an on-disk ACL.
+type aclRecord struct {
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+	ACL     ACL    `json:"acl"`
+}
+
+type signedACL struct {
+	Record aclRecord `json:"record"`
+	Sig    []byte    `json:"sig"`
+}
+
+// ACLStore persists ACLs as signed JSON blobs, one file per path, so that
+// tampering with the on-disk data is detected on load - the signature
+// covers the whole record, not just the ACL itself.
+type ACLStore struct {
+	directory string
+	key       []byte
+}
+
+// NewACLStore opens (creating if necessary) an ACLStore rooted at
+// directory, signing and verifying entries with key.
+func NewACLStore(directory string, key []byte) (*ACLStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &ACLStore{directory, key}, nil
+}
+
+func (s *ACLStore) filename(path string) string {
+	name := strings.Replace(path, "/", "_", -1)
+	if name == "" {
+		name = "_root_"
+	}
+	return filepath.Join(s.directory, name+".acl")
+}
+
+// Sign computes the signature to pass to Set for an ACL at path.
+func (s *ACLStore) Sign(path string, acl ACL) []byte {
+	return s.sign(aclRecord{Version: 1, Path: path, ACL: acl})
+}
+
+func (s *ACLStore) sign(record aclRecord) []byte {
+	data, _ := json.Marshal(record)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Get returns the ACL set at path, verifying its signature.
+func (s *ACLStore) Get(path string) (ACL, error) {
+	data, err := ioutil.ReadFile(s.filename(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoACL
+		}
+		return nil, err
+	}
+
+	var blob signedACL
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(s.sign(blob.Record), blob.Sig) {
+		return nil, ErrBadACLSignature
+	}
+
+	return blob.Record.ACL, nil
+}
+
+// Set stores acl at path, signed with sig (as produced by Sign).
+func (s *ACLStore) Set(path string, acl ACL, sig []byte) error {
+	blob := signedACL{Record: aclRecord{Version: 1, Path: path, ACL: acl}, Sig: sig}
+
+	data, err := json.MarshalIndent(blob, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.filename(path), data, 0600)
+}
+
+// MigrateACLs writes the default ACLs that reproduce today's hard-coded
+// ROOT/USER/FAMILY/DEVICE/ENABLED tiers, so that installs upgrading to the
+// ACL model see no change in behavior until an admin edits the ACLs.
+func MigrateACLs(store *ACLStore) error {
+	defaults := map[string]ACL{
+		// global operations that used to check GeneralPermissions() directly
+		"": {
+			"root":    {Admin, Read},
+			"user":    {Read},
+			"family":  {Read},
+			"device":  {Read},
+			"enabled": {Read},
+		},
+		// RelationToUser-gated operations
+		"user": {
+			"root":   {Admin, Write, Read, Resolve},
+			"user":   {Write, Read, Resolve},
+			"family": {Read, Resolve},
+		},
+		// RelationToDevice-gated operations
+		"device": {
+			"root":   {Admin, Write, Read, Resolve},
+			"user":   {Admin, Write, Read, Resolve},
+			"family": {Write, Read, Resolve},
+			"device": {Write, Resolve},
+		},
+		// RelationToStream-gated operations
+		"stream": {
+			"root":   {Write, Resolve},
+			"user":   {Write, Resolve},
+			"family": {Read, Resolve},
+			"device": {Read, Resolve},
+		},
+	}
+
+	for path, acl := range defaults {
+		if err := store.Set(path, acl, store.Sign(path, acl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize finds the ACL governing path (walking up to the nearest
+// ancestor that has one set, falling back to the global "" ACL) and checks
+// whether o's device - given its relation to whatever path resolves to -
+// is granted op.
+func (o *Operator) authorize(path string, op Op) error {
+	tag, err := o.relationTag(path)
+	if err != nil {
+		return err
+	}
+	return o.authorizeTag(path, tag, op)
+}
+
+// authorizeTag is authorize for a caller that already knows the ACL tag o's
+// device holds with respect to path - e.g. because it already loaded the
+// user/device/stream path names and can compute RelationTo* directly,
+// rather than paying for relationTag's DB fetch of something already in
+// hand. Only ErrNoACL is treated as "deny"; any other findACL error (a
+// tampered signature, a read failure) is returned as-is rather than masked
+// as PERMISSION_ERROR, so callers can tell "not allowed" from "couldn't
+// check".
+func (o *Operator) authorizeTag(path, tag string, op Op) error {
+	acl, err := o.findACL(path)
+	if err != nil {
+		if err == ErrNoACL {
+			return PERMISSION_ERROR
+		}
+		return err
+	}
+
+	for _, t := range qualifyingTags(tag) {
+		if acl.Grants(t, op) {
+			return nil
+		}
+	}
+	return PERMISSION_ERROR
+}
+
+// findACL walks path upward (e.g. "device/5/streams" -> "device/5" ->
+// "device" -> "") until it finds an ACL entry.
+func (o *Operator) findACL(path string) (ACL, error) {
+	for {
+		acl, err := o.acl.Get(path)
+		if err == nil {
+			return acl, nil
+		}
+		if err != ErrNoACL {
+			return nil, err
+		}
+		if path == "" {
+			return nil, ErrNoACL
+		}
+		if idx := strings.LastIndex(path, "/"); idx >= 0 {
+			path = path[:idx]
+		} else {
+			path = ""
+		}
+	}
+}
+
+// relationTag computes the ACL tag o's device holds with respect to path.
+// An empty path means "the global ACL", checked against the device's
+// general permissions rather than its relation to a specific target.
+func (o *Operator) relationTag(path string) (string, error) {
+	if path == "" {
+		return tagForLevel(o.dev.GeneralPermissions()), nil
+	}
+
+	kind, id, err := splitACLPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case "user":
+		u, err := o.GetDatabase().ReadUserById(id)
+		if err != nil {
+			return "", err
+		}
+		return tagForLevel(o.dev.RelationToUser(u)), nil
+	case "device":
+		d, err := o.GetDatabase().ReadDeviceById(id)
+		if err != nil {
+			return "", err
+		}
+		return tagForLevel(o.dev.RelationToDevice(d)), nil
+	case "stream":
+		s, err := o.GetDatabase().ReadStreamById(id)
+		if err != nil {
+			return "", err
+		}
+		d, err := o.GetDatabase().ReadDeviceById(s.DeviceId)
+		if err != nil {
+			return "", err
+		}
+		return tagForLevel(o.dev.RelationToStream(s, d)), nil
+	default:
+		return "", INVALID_PATH_ERROR
+	}
+}
+
+// splitACLPath parses the "<kind>/<id>" form used for the ACL paths
+// authorize and relationTag deal in - e.g. "user/5" -> ("user", 5).
+func splitACLPath(path string) (kind string, id int64, err error) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return "", 0, INVALID_PATH_ERROR
+	}
+
+	id, parseErr := strconv.ParseInt(parts[1], 10, 64)
+	if parseErr != nil {
+		return "", 0, INVALID_PATH_ERROR
+	}
+	return parts[0], id, nil
+}
+
+// GetPermissions returns the ACL set directly at path (no ancestor
+// inheritance - see authorize for that resolution). Requires Admin on the
+// global ACL.
+func (o *Operator) GetPermissions(path string) (ACL, error) {
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
+	}
+	return o.acl.Get(path)
+}
+
+// SetPermissions overwrites the ACL at path, signed with the operator's ACL
+// store's key. Requires Admin on the global ACL.
+func (o *Operator) SetPermissions(path string, acl ACL) error {
+	if err := o.authorize("", Admin); err != nil {
+		return err
+	}
+	return o.acl.Set(path, acl, o.acl.Sign(path, acl))
+}
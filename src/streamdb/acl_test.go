@@ -0,0 +1,143 @@
+package streamdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"streamdb/users"
+)
+
+func TestTagForLevel(t *testing.T) {
+	cases := []struct {
+		level users.PermissionLevel
+		want  string
+	}{
+		{users.ROOT, "root"},
+		{users.USER, "user"},
+		{users.FAMILY, "family"},
+		{users.DEVICE, "device"},
+		{users.ENABLED, "enabled"},
+		{users.NEGATIVE, "negative"},
+	}
+	for _, c := range cases {
+		if got := tagForLevel(c.level); got != c.want {
+			t.Errorf("tagForLevel(%v) = %q, want %q", c.level, got, c.want)
+		}
+	}
+}
+
+func TestQualifyingTags(t *testing.T) {
+	cases := []struct {
+		tag  string
+		want []string
+	}{
+		{"root", []string{"negative", "enabled", "device", "family", "user", "root"}},
+		{"family", []string{"negative", "enabled", "device", "family"}},
+		{"negative", []string{"negative"}},
+		{"bogus", nil},
+	}
+	for _, c := range cases {
+		got := qualifyingTags(c.tag)
+		if len(got) != len(c.want) {
+			t.Errorf("qualifyingTags(%q) = %v, want %v", c.tag, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("qualifyingTags(%q) = %v, want %v", c.tag, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestACLGrants(t *testing.T) {
+	acl := ACL{"family": {Read, Resolve}}
+	if !acl.Grants("family", Read) {
+		t.Error("expected family to be granted Read")
+	}
+	if acl.Grants("family", Write) {
+		t.Error("did not expect family to be granted Write")
+	}
+	if acl.Grants("device", Read) {
+		t.Error("did not expect an absent tag to be granted anything")
+	}
+}
+
+// testACLStore returns an ACLStore rooted at a fresh temp directory, torn
+// down when the test finishes.
+func testACLStore(t *testing.T) *ACLStore {
+	dir, err := ioutil.TempDir("", "acltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewACLStore(dir, []byte("testkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestAuthorizeTagDefaults exercises authorizeTag against the exact defaults
+// MigrateACLs seeds, covering every tier MigrateACLs claims to reproduce -
+// including the family/stream case that used to be missing from the
+// "stream" defaults.
+func TestAuthorizeTagDefaults(t *testing.T) {
+	store := testACLStore(t)
+	if err := MigrateACLs(store); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path string
+		tag  string
+		op   Op
+		want bool
+	}{
+		{"user", "root", Admin, true},
+		{"user", "family", Read, true},
+		{"user", "family", Write, false},
+		{"device", "device", Write, true},
+		{"device", "enabled", Write, false},
+		{"stream", "root", Resolve, true},
+		{"stream", "family", Resolve, true},
+		{"stream", "family", Read, true},
+		{"stream", "enabled", Read, false},
+	}
+	for _, c := range cases {
+		o := &Operator{acl: store}
+		err := o.authorizeTag(c.path, c.tag, c.op)
+		got := err == nil
+		if got != c.want {
+			t.Errorf("authorizeTag(%q, %q, %v) allowed=%v, want %v (err=%v)", c.path, c.tag, c.op, got, c.want, err)
+		}
+	}
+}
+
+// TestAuthorizeTagNoACL checks that a path with no ACL set anywhere up its
+// ancestry (including no global ACL) denies rather than erroring.
+func TestAuthorizeTagNoACL(t *testing.T) {
+	store := testACLStore(t)
+	o := &Operator{acl: store}
+	if err := o.authorizeTag("user/5", "root", Admin); err != PERMISSION_ERROR {
+		t.Errorf("authorizeTag with no ACL set = %v, want PERMISSION_ERROR", err)
+	}
+}
+
+// TestAuthorizeTagBadSignature checks that a tampered ACL surfaces
+// ErrBadACLSignature rather than being silently treated as a denial.
+func TestAuthorizeTagBadSignature(t *testing.T) {
+	store := testACLStore(t)
+	acl := ACL{"root": {Admin}}
+	if err := store.Set("user", acl, []byte("wrong-signature")); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Operator{acl: store}
+	if err := o.authorizeTag("user/5", "root", Admin); err != ErrBadACLSignature {
+		t.Errorf("authorizeTag with tampered ACL = %v, want ErrBadACLSignature", err)
+	}
+}
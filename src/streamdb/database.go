@@ -0,0 +1,50 @@
+package streamdb
+
+import (
+	"path/filepath"
+
+	"streamdb/users"
+)
+
+// aclDirName is the subdirectory of a streamdb directory that holds the
+// signed ACL files backing Database.ACLStore().
+const aclDirName = "acl"
+
+// Database is the handle every Operator proxies through - it pairs the
+// users.UserDatabase (user/device/stream storage) with the ACLStore that
+// authorize checks against.
+type Database struct {
+	*users.UserDatabase
+
+	directory string
+	acl       *ACLStore
+}
+
+// Open opens (creating if necessary) the Database rooted at directory, on
+// top of the already-open udb. It also opens directory's ACLStore, signed
+// with aclKey, and - the first time it is opened, i.e. it has no global ACL
+// set yet - seeds it via MigrateACLs. That keeps a fresh install's behavior
+// identical to the old hard-coded ROOT/USER/FAMILY/DEVICE/ENABLED tiers
+// until an admin edits the ACLs, rather than leaving every Operator call
+// locked out with PERMISSION_ERROR until something remembers to migrate.
+func Open(directory string, udb *users.UserDatabase, aclKey []byte) (*Database, error) {
+	store, err := NewACLStore(filepath.Join(directory, aclDirName), aclKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := store.Get(""); err == ErrNoACL {
+		if err := MigrateACLs(store); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Database{UserDatabase: udb, directory: directory, acl: store}, nil
+}
+
+// ACLStore returns the ACLStore that db's Operators authorize against.
+func (db *Database) ACLStore() *ACLStore {
+	return db.acl
+}
@@ -0,0 +1,168 @@
+package dbmaker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+)
+
+//privsepEnvVar is set by ReexecAsChild/MaybeBecomeChild as the "magic"
+//marker that tells a re-exec'd connectordb it is running in the child role,
+//and how many extra file descriptors (passed via ExtraFiles) it was handed.
+const privsepEnvVar = "CONNECTORDB_PRIVSEP_FDS"
+
+//ErrAlreadyChild is returned by MaybeBecomeChild if it is called more than
+//once in the same process.
+var ErrAlreadyChild = errors.New("MaybeBecomeChild was already called in this process")
+
+//ErrPrivsepUnsupported is returned by LaunchAs on platforms that don't
+//support dropping uid/gid via SysProcAttr.Credential.
+var ErrPrivsepUnsupported = errors.New("privilege-separated launch is not supported on this platform")
+
+var becameChild bool
+
+//LaunchConfig describes how a privileged parent should drop itself down
+//before handing control to a child process.
+type LaunchConfig struct {
+	//UID/GID the child runs as, after LaunchAs drops root.
+	UID, GID uint32
+	//Chroot, if set, is applied to the child before execve.
+	Chroot string
+	//EnvWhitelist lists the environment variables (from the parent's own
+	//environment) that are passed through to the child. Everything else is
+	//stripped, so a root parent's full environment is never handed to an
+	//unprivileged postgres/redis/gnatsd.
+	EnvWhitelist []string
+	//ExtraFiles are handed to the child beyond stdin/stdout/stderr (e.g.
+	//already-open log files or listen sockets), and are visible to the
+	//child via MaybeBecomeChild as fd 3, 4, ...
+	ExtraFiles []*os.File
+}
+
+//filterEnv keeps only the entries of env whose key is in whitelist.
+func filterEnv(env, whitelist []string) []string {
+	allowed := make(map[string]bool, len(whitelist))
+	for _, k := range whitelist {
+		allowed[k] = true
+	}
+
+	filtered := make([]string, 0, len(whitelist))
+	for _, kv := range env {
+		for k := range allowed {
+			if len(kv) > len(k) && kv[:len(k)] == k && kv[len(k)] == '=' {
+				filtered = append(filtered, kv)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+//ReexecAsChild re-execs the current binary with privsepEnvVar set to the
+//number of extraFiles, handing them down via cmd.ExtraFiles. It's the
+//counterpart to MaybeBecomeChild: a parent calls this instead of LaunchAs
+//when the child role is "be this same binary, but acting on file
+//descriptors I already opened" rather than an external command.
+func ReexecAsChild(extraFiles []*os.File) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", privsepEnvVar, len(extraFiles)))
+	cmd.ExtraFiles = extraFiles
+	return cmd
+}
+
+//MaybeBecomeChild checks whether this process was started by
+//ReexecAsChild's privsep marker. If so, it returns the extra file
+//descriptors the parent handed down (fd 3, 4, ... -> files[0], files[1],
+//...) and isChild is true. main() should call this before doing any other
+//setup, and if isChild is true, run only whatever reduced child logic needs
+//those file descriptors rather than the full connectordb startup.
+func MaybeBecomeChild() (isChild bool, files []*os.File, err error) {
+	if becameChild {
+		return false, nil, ErrAlreadyChild
+	}
+
+	countStr := os.Getenv(privsepEnvVar)
+	if countStr == "" {
+		return false, nil, nil
+	}
+	becameChild = true
+
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return true, nil, err
+	}
+
+	files = make([]*os.File, count)
+	for i := 0; i < count; i++ {
+		files[i] = os.NewFile(uintptr(3+i), fmt.Sprintf("extrafile%d", i))
+	}
+
+	return true, files, nil
+}
+
+//LaunchConfigForUser resolves username - as read from the streamdb.user
+//config key - into the LaunchConfig that Register/Supervise should use to
+//drop privileges before running postgres/redis/gnatsd. An empty username
+//means "do not privilege-separate", reported via ok=false so the caller
+//knows to pass a nil *LaunchConfig through instead.
+func LaunchConfigForUser(username string, envWhitelist []string, chroot string) (cfg *LaunchConfig, ok bool, err error) {
+	if username == "" {
+		return nil, false, nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, false, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &LaunchConfig{
+		UID:          uint32(uid),
+		GID:          uint32(gid),
+		Chroot:       chroot,
+		EnvWhitelist: envWhitelist,
+	}, true, nil
+}
+
+//Bootstrap is the first thing a connectordb main should call, before any
+//other startup work:
+//
+//  1. It checks whether this process is a privsep child re-exec'd by
+//     ReexecAsChild (see MaybeBecomeChild). If isChild is true, main must
+//     stop and run only the reduced child logic for files - not the normal
+//     connectordb startup.
+//  2. Otherwise it resolves the streamdb.user config key (serviceUser) via
+//     LaunchConfigForUser, so main doesn't have to duplicate the
+//     user.Lookup/uid-parsing dance before calling Supervisor.Register or
+//     Supervise. privsep is nil when serviceUser is empty.
+func Bootstrap(serviceUser string, envWhitelist []string, chroot string) (isChild bool, files []*os.File, privsep *LaunchConfig, err error) {
+	isChild, files, err = MaybeBecomeChild()
+	if err != nil || isChild {
+		return isChild, files, nil, err
+	}
+
+	cfg, ok, err := LaunchConfigForUser(serviceUser, envWhitelist, chroot)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if !ok {
+		return false, nil, nil, nil
+	}
+	return false, nil, cfg, nil
+}
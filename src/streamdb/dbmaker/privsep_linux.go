@@ -0,0 +1,30 @@
+// +build linux
+
+package dbmaker
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+//LaunchAs builds an *exec.Cmd for command that, once started, drops
+//privileges to cfg.UID/cfg.GID (and cfg.Chroot, if set) before the target
+//binary is exec'd, using SysProcAttr.Credential. It does not start the
+//command - callers wire up Stdout/Stderr/Dir as usual and call Start/Run
+//themselves.
+func LaunchAs(cfg LaunchConfig, command string, args ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(command, args...)
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: cfg.UID, Gid: cfg.GID},
+	}
+	if cfg.Chroot != "" {
+		cmd.SysProcAttr.Chroot = cfg.Chroot
+	}
+
+	cmd.Env = filterEnv(os.Environ(), cfg.EnvWhitelist)
+	cmd.ExtraFiles = cfg.ExtraFiles
+
+	return cmd, nil
+}
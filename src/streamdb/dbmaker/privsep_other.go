@@ -0,0 +1,16 @@
+// +build !linux
+
+package dbmaker
+
+import (
+	"os/exec"
+)
+
+//LaunchAs is not yet implemented outside Linux - there is no portable
+//equivalent of SysProcAttr.Credential. It returns ErrPrivsepUnsupported
+//rather than silently running command as the caller's own uid/gid, since a
+//root caller relying on privilege drop having happened must not be handed a
+//cmd that looks fine but isn't.
+func LaunchAs(cfg LaunchConfig, command string, args ...string) (*exec.Cmd, error) {
+	return nil, ErrPrivsepUnsupported
+}
@@ -69,23 +69,78 @@ func RunCommand(err error, command string, args ...string) error {
 	return cmd.Run()
 }
 
-//RunDaemon runs the given command as a daemon (in the background)
-func RunDaemon(err error, command string, args ...string) error {
+//Supervise starts the currently-installed version of service (as laid out by
+//InstallVersion) as a daemon. Unlike the old RunDaemon, stdout/stderr are not
+//inherited from the calling process - each run gets its own fresh
+//logs/STDOUT-<timestamp> and logs/STDERR-<timestamp> files, and the child's
+//PID is written to data/info (as well as the legacy <service>.pid file, so
+//GetProcess/StopProcess/KillProcess keep working unmodified).
+//
+//If privsep is non-nil, the service is started via LaunchAs instead of
+//inheriting the caller's uid/gid - this is how a root connectordb drops
+//postgres/redis/gnatsd down to an unprivileged account before exec.
+func Supervise(streamdbDirectory, service string, privsep *LaunchConfig, err error) error {
 	if err != nil {
 		return err
 	}
-	log.Printf(cmd2Str(command, args...))
 
-	cmd := exec.Command(command, args...)
+	svcDir := serviceDir(streamdbDirectory, service)
+	dDir := dataDir(svcDir)
 
-	//No need for redirecting stuff, since log/pid files are configured in .conf files
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	script := filepath.Join(currentLink(svcDir), "service.sh")
+	if !util.PathExists(script) {
+		return ErrNoCurrentVersion
+	}
+
+	args, err := readPersistentArgs(dDir)
+	if err != nil {
+		return err
+	}
+
+	ts := time.Now().UTC().Format(versionTimeFormat)
+	lDir := logsDir(dDir)
+	if err := os.MkdirAll(lDir, 0755); err != nil {
+		return err
+	}
+
+	stdout, err := os.Create(filepath.Join(lDir, "STDOUT-"+ts))
+	if err != nil {
+		return err
+	}
+	stderr, err := os.Create(filepath.Join(lDir, "STDERR-"+ts))
+	if err != nil {
+		return err
+	}
+
+	log.Printf(cmd2Str(script, args...))
+
+	var cmd *exec.Cmd
+	if privsep != nil {
+		cmd, err = LaunchAs(*privsep, script, args...)
+		if err != nil {
+			return err
+		}
+	} else {
+		cmd = exec.Command(script, args...)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// The child inherited its own dup'd copies of these fds on Start - the
+	// parent's handles just leak otherwise, since Supervise restarts the
+	// service for as long as the connectordb process lives.
+	stdout.Close()
+	stderr.Close()
+
+	pidfile := filepath.Join(streamdbDirectory, service+".pid")
+	if err := ioutil.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		return err
+	}
 
-	//I am not convinced at the moment that restarting postgres/other stuff will be a good idea
-	//especially since that is what happens when we want to kill them from another process.
-	//So, for the moment, just start the process
-	return cmd.Start()
+	return writeInfo(dDir, cmd.Process.Pid, service)
 }
 
 //GetProcess gets the gven process using its process name
@@ -0,0 +1,403 @@
+package dbmaker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	//minBackoff is the restart delay after the first unexpected exit
+	minBackoff = 1 * time.Second
+	//maxBackoff caps the exponential backoff between restarts
+	maxBackoff = 60 * time.Second
+	//healthyRunTime is how long a service has to stay up before its backoff
+	//resets back to minBackoff
+	healthyRunTime = 5 * time.Minute
+	//stopGrace is how long StopAll/Stop waits after SIGINT before SIGKILL
+	stopGrace = 10 * time.Second
+)
+
+//HealthCheck reports an error if a service has not come up correctly. A
+//failing check gets the service killed, which feeds into the same
+//backoff/restart loop as an unexpected exit. Use WaitPort for services that
+//just need to start listening on a port, or a custom func() error for
+//anything else.
+type HealthCheck func() error
+
+//WaitPortCheck returns a HealthCheck that waits for host:port to accept
+//connections.
+func WaitPortCheck(host string, port int) HealthCheck {
+	return func() error {
+		return WaitPort(host, port, nil)
+	}
+}
+
+//ServiceStatus is a snapshot of a single registered service, as returned by
+//Supervisor.Status.
+type ServiceStatus struct {
+	Name         string
+	PID          int
+	Uptime       time.Duration
+	LastExitCode int
+	RestartTimes []time.Time
+}
+
+//serviceState is what gets persisted to <streamdbDirectory>/<service>.state.json,
+//so a fresh connectordb invocation can attach to an already-running child
+//rather than re-forking it.
+type serviceState struct {
+	PID          int         `json:"pid"`
+	StartedAt    time.Time   `json:"startedAt"`
+	RestartTimes []time.Time `json:"restartTimes"`
+	LastExitCode int         `json:"lastExitCode"`
+}
+
+type registeredService struct {
+	name    string
+	command string
+	args    []string
+	health  HealthCheck
+	privsep *LaunchConfig
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	attachedTo *os.Process
+	startedAt  time.Time
+	exitCode   int
+	restarts   []time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//Supervisor owns a set of daemons started via Register, restarting them
+//with exponential backoff when they exit unexpectedly. It is the direct
+//replacement for the old fire-and-forget RunDaemon.
+type Supervisor struct {
+	streamdbDirectory string
+
+	mu       sync.Mutex
+	services map[string]*registeredService
+}
+
+//NewSupervisor creates a Supervisor that persists service state under
+//streamdbDirectory.
+func NewSupervisor(streamdbDirectory string) *Supervisor {
+	return &Supervisor{
+		streamdbDirectory: streamdbDirectory,
+		services:          make(map[string]*registeredService),
+	}
+}
+
+func (s *Supervisor) statePath(name string) string {
+	return filepath.Join(s.streamdbDirectory, name+".state.json")
+}
+
+func (s *Supervisor) saveState(name string, rs *registeredService) {
+	rs.mu.Lock()
+	state := serviceState{
+		PID:          rs.pid(),
+		StartedAt:    rs.startedAt,
+		RestartTimes: rs.restarts,
+		LastExitCode: rs.exitCode,
+	}
+	rs.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("dbmaker: could not marshal state for %v: %v", name, err)
+		return
+	}
+	if err := ioutil.WriteFile(s.statePath(name), data, 0644); err != nil {
+		log.Printf("dbmaker: could not persist state for %v: %v", name, err)
+	}
+}
+
+//loadState reads back the state persisted by saveState, so a supervising
+//process that restarts and re-Registers a still-running child doesn't lose
+//its restart/backoff history. Returns ok=false if there is nothing usable to
+//load (no file yet, or it was written by some earlier, unrelated process).
+func (s *Supervisor) loadState(name string, pid int) (state serviceState, ok bool) {
+	data, err := ioutil.ReadFile(s.statePath(name))
+	if err != nil {
+		return serviceState{}, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return serviceState{}, false
+	}
+	if state.PID != pid {
+		return serviceState{}, false
+	}
+	return state, true
+}
+
+func (rs *registeredService) pid() int {
+	if rs.attachedTo != nil {
+		return rs.attachedTo.Pid
+	}
+	if rs.cmd == nil || rs.cmd.Process == nil {
+		return 0
+	}
+	return rs.cmd.Process.Pid
+}
+
+//Register starts command (with the given args) under the name "name" and
+//keeps it running: on an unexpected exit it is restarted with exponential
+//backoff (1s, 2s, 4s, ... capped at 60s), the backoff resetting to 1s once a
+//run has stayed up for more than 5 minutes. If a process is already running
+//for name (per GetProcess/<name>.pid), Register attaches to it instead of
+//forking a new one. If privsep is non-nil, every (re)start goes through
+//LaunchAs instead of inheriting the Supervisor's own uid/gid.
+func (s *Supervisor) Register(name, command string, args []string, health HealthCheck, privsep *LaunchConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.services[name]; exists {
+		return nil
+	}
+
+	rs := &registeredService{
+		name:    name,
+		command: command,
+		args:    args,
+		health:  health,
+		privsep: privsep,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.services[name] = rs
+
+	if p, err := GetProcess(s.streamdbDirectory, name, nil); err == nil {
+		rs.attachedTo = p
+		if state, ok := s.loadState(name, p.Pid); ok {
+			rs.startedAt = state.StartedAt
+			rs.restarts = state.RestartTimes
+			rs.exitCode = state.LastExitCode
+			log.Printf("dbmaker: attaching to already-running %v (pid %v), restored state", name, p.Pid)
+		} else {
+			rs.startedAt = time.Now()
+			log.Printf("dbmaker: attaching to already-running %v (pid %v), no matching saved state", name, p.Pid)
+		}
+	}
+
+	go s.run(rs)
+	return nil
+}
+
+func (s *Supervisor) run(rs *registeredService) {
+	defer close(rs.done)
+
+	backoff := minBackoff
+	for {
+		select {
+		case <-rs.stop:
+			return
+		default:
+		}
+
+		if rs.attachedTo != nil {
+			if !s.waitForExit(rs, rs.attachedTo) {
+				return
+			}
+			rs.mu.Lock()
+			rs.attachedTo = nil
+			rs.mu.Unlock()
+			continue
+		}
+
+		var cmd *exec.Cmd
+		if rs.privsep != nil {
+			var err error
+			cmd, err = LaunchAs(*rs.privsep, rs.command, rs.args...)
+			if err != nil {
+				log.Printf("dbmaker: %v failed to build privsep launch: %v", rs.name, err)
+				if !s.sleepOrStop(rs, backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		} else {
+			cmd = exec.Command(rs.command, rs.args...)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Start(); err != nil {
+			log.Printf("dbmaker: %v failed to start: %v", rs.name, err)
+			if !s.sleepOrStop(rs, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		rs.mu.Lock()
+		rs.cmd = cmd
+		rs.startedAt = time.Now()
+		rs.mu.Unlock()
+
+		pidfile := filepath.Join(s.streamdbDirectory, rs.name+".pid")
+		ioutil.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		s.saveState(rs.name, rs)
+
+		waitErr := make(chan error, 1)
+		go func() { waitErr <- cmd.Wait() }()
+
+		if rs.health != nil {
+			if err := rs.health(); err != nil {
+				log.Printf("dbmaker: %v failed its health check: %v - killing it", rs.name, err)
+				cmd.Process.Kill()
+			}
+		}
+
+		var exitErr error
+		select {
+		case exitErr = <-waitErr:
+		case <-rs.stop:
+			return
+		}
+
+		rs.mu.Lock()
+		rs.exitCode = exitCodeOf(exitErr)
+		ran := time.Since(rs.startedAt)
+		rs.restarts = append(rs.restarts, time.Now())
+		rs.mu.Unlock()
+		s.saveState(rs.name, rs)
+
+		log.Printf("dbmaker: %v exited after %v: %v", rs.name, ran, exitErr)
+
+		if ran > healthyRunTime {
+			backoff = minBackoff
+		}
+
+		if !s.sleepOrStop(rs, backoff) {
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+//waitForExit polls an attached (not forked-by-us) process for exit, since
+//we can't call Wait on a process we didn't start ourselves.
+func (s *Supervisor) waitForExit(rs *registeredService, p *os.Process) bool {
+	const pollInterval = 1 * time.Second
+	for {
+		select {
+		case <-rs.stop:
+			return false
+		case <-time.After(pollInterval):
+		}
+		if p.Signal(syscall.Signal(0)) != nil {
+			return true
+		}
+	}
+}
+
+func (s *Supervisor) sleepOrStop(rs *registeredService, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-rs.stop:
+		return false
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+//Stop sends SIGINT to the named service, escalating to SIGKILL after
+//stopGrace if it has not exited.
+func (s *Supervisor) Stop(name string) error {
+	s.mu.Lock()
+	rs, ok := s.services[name]
+	s.mu.Unlock()
+	if !ok {
+		return ErrProcessNotFound
+	}
+
+	rs.stopOnce.Do(func() { close(rs.stop) })
+
+	rs.mu.Lock()
+	proc := rs.attachedTo
+	if proc == nil && rs.cmd != nil {
+		proc = rs.cmd.Process
+	}
+	rs.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+
+	proc.Signal(os.Interrupt)
+
+	select {
+	case <-rs.done:
+		return nil
+	case <-time.After(stopGrace):
+		return proc.Kill()
+	}
+}
+
+//StopAll stops every registered service.
+func (s *Supervisor) StopAll() error {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, name := range names {
+		if err := s.Stop(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Status returns the current state of every registered service.
+func (s *Supervisor) Status() []ServiceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ServiceStatus, 0, len(s.services))
+	for name, rs := range s.services {
+		rs.mu.Lock()
+		statuses = append(statuses, ServiceStatus{
+			Name:         name,
+			PID:          rs.pid(),
+			Uptime:       time.Since(rs.startedAt),
+			LastExitCode: rs.exitCode,
+			RestartTimes: append([]time.Time(nil), rs.restarts...),
+		})
+		rs.mu.Unlock()
+	}
+	return statuses
+}
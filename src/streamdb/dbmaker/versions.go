@@ -0,0 +1,242 @@
+package dbmaker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"streamdb/util"
+)
+
+var (
+	//ErrNoCurrentVersion is returned when a service has no "current" symlink yet
+	ErrNoCurrentVersion = errors.New("The service has no current version installed")
+	//ErrNoPreviousVersion is returned when Revert is called and there is nothing to revert to
+	ErrNoPreviousVersion = errors.New("There is no previous version to revert to")
+)
+
+//versionTimeFormat is used to name each versions/<timestamp> directory, and
+//the STDOUT-<timestamp>/STDERR-<timestamp> log files. It sorts lexically in
+//the same order as chronologically, which Revert relies on.
+const versionTimeFormat = "20060102T150405.000000000"
+
+//serviceDir is <streamdbDirectory>/<service>, the root of a single managed
+//service's versioned layout.
+func serviceDir(streamdbDirectory, service string) string {
+	return filepath.Join(streamdbDirectory, service)
+}
+
+func versionsDir(svcDir string) string {
+	return filepath.Join(svcDir, "versions")
+}
+
+func currentLink(svcDir string) string {
+	return filepath.Join(svcDir, "current")
+}
+
+func dataDir(svcDir string) string {
+	return filepath.Join(svcDir, "data")
+}
+
+func logsDir(dDir string) string {
+	return filepath.Join(dDir, "logs")
+}
+
+func persistentArgsFile(dDir string) string {
+	return filepath.Join(dDir, "persistent-args")
+}
+
+func infoFile(dDir string) string {
+	return filepath.Join(dDir, "info")
+}
+
+//InstallVersion stages srcDir as a new version of service under
+//streamdbDirectory and atomically flips the "current" symlink to point at
+//it. The previously-running process (if any) is left completely alone -
+//callers must follow up with Supervise (and likely StopProcess first) to
+//actually run the new version.
+func InstallVersion(streamdbDirectory, service, srcDir string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	svcDir := serviceDir(streamdbDirectory, service)
+	dDir := dataDir(svcDir)
+
+	if err := os.MkdirAll(dDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(logsDir(dDir), 0755); err != nil {
+		return err
+	}
+	if !util.PathExists(persistentArgsFile(dDir)) {
+		if err := ioutil.WriteFile(persistentArgsFile(dDir), []byte("[]"), 0644); err != nil {
+			return err
+		}
+	}
+
+	version := time.Now().UTC().Format(versionTimeFormat)
+	dest := filepath.Join(versionsDir(svcDir), version)
+
+	if err := copyTree(srcDir, dest); err != nil {
+		return err
+	}
+
+	return swapCurrent(currentLink(svcDir), relativeVersionTarget(version))
+}
+
+//Revert points service's "current" symlink back at the version that was
+//installed immediately before the one it currently points to. Like
+//InstallVersion, it does not touch the running process.
+func Revert(streamdbDirectory, service string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	svcDir := serviceDir(streamdbDirectory, service)
+
+	curTarget, err := os.Readlink(currentLink(svcDir))
+	if err != nil {
+		return ErrNoCurrentVersion
+	}
+
+	versions, err := sortedVersions(versionsDir(svcDir))
+	if err != nil {
+		return err
+	}
+
+	curName := filepath.Base(curTarget)
+	idx := -1
+	for i, v := range versions {
+		if v == curName {
+			idx = i
+			break
+		}
+	}
+	if idx <= 0 {
+		return ErrNoPreviousVersion
+	}
+
+	return swapCurrent(currentLink(svcDir), relativeVersionTarget(versions[idx-1]))
+}
+
+//relativeVersionTarget returns the symlink target swapCurrent should use for
+//version, relative to svcDir (the directory "current" lives in) rather than
+//absolute - so "current" keeps resolving after the streamdb directory is
+//moved, restored from backup, or the service is run inside a Chroot.
+func relativeVersionTarget(version string) string {
+	return filepath.Join("versions", version)
+}
+
+//swapCurrent repoints link at target by writing a new symlink under a
+//temporary name and renaming it over link, so a reader never sees a missing
+//or partially-written symlink. target should be relative to link's directory
+//(see relativeVersionTarget) so the symlink survives relocation.
+func swapCurrent(link, target string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+//sortedVersions lists the installed versions of a service, oldest first.
+//Version directories are named from versionTimeFormat, so a plain string
+//sort is also a chronological sort.
+func sortedVersions(vDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(vDir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+//copyTree recursively copies src onto dst, creating dst and any
+//intermediate directories as needed and preserving file modes.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+//readPersistentArgs loads the JSON-encoded argument list that is passed to
+//the service's service.sh on every Supervise call.
+func readPersistentArgs(dDir string) ([]string, error) {
+	data, err := ioutil.ReadFile(persistentArgsFile(dDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+//serviceInfo is the content of data/info: enough for another connectordb
+//invocation to find and reason about an already-running child.
+type serviceInfo struct {
+	PID    int    `json:"pid"`
+	Object string `json:"object"`
+}
+
+func writeInfo(dDir string, pid int, object string) error {
+	data, err := json.Marshal(serviceInfo{PID: pid, Object: object})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(infoFile(dDir), data, 0644)
+}
@@ -3,7 +3,7 @@ package streamdb
 import (
 	"streamdb/users"
 	"errors"
-	"strings"
+	"fmt"
 )
 
 var (
@@ -15,7 +15,7 @@ var (
 //Returns the Administrator device (which has all possible permissions)
 //Having a nil users.Device means that it is administrator
 func (db *Database) GetAdminOperator() *Operator {
-	return &Operator{db, nil}
+	return &Operator{db, nil, db.ACLStore()}
 }
 
 //Given an API key, returns the  Device object
@@ -24,7 +24,7 @@ func (db *Database) GetOperator(apikey string) (*Operator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Operator{db, dev}, nil
+	return &Operator{db, dev, db.ACLStore()}, nil
 }
 
 
@@ -34,6 +34,7 @@ func (db *Database) GetOperator(apikey string) (*Operator, error) {
 type Operator struct {
 	db *Database // the database this operator works on
 	dev *users.Device // the device behind this operator
+	acl *ACLStore // the ACLs that govern what dev may do
 }
 
 // The operating environment for a particular operator request,
@@ -57,24 +58,24 @@ func (o *Operator) GetDatabase() (*Database) {
 
 // Creates a user with a username, password, and email string
 func (o *Operator) CreateUser(username, email, password string) error {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().CreateUser(username, email, password)
 }
 
 func (o *Operator) ReadUser(username string) (*users.User, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadUserByName(username)
 }
 
 func (o *Operator) ReadUserById(id int64) (*users.User, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadUserById(id)
@@ -83,8 +84,8 @@ func (o *Operator) ReadUserById(id int64) (*users.User, error) {
 
 // Returns a User instance if a user exists with the given email address
 func (o *Operator) ReadUserByEmail(email string) (*users.User, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadUserByEmail(email)
@@ -92,8 +93,8 @@ func (o *Operator) ReadUserByEmail(email string) (*users.User, error) {
 
 // Fetches all users from the database
 func (o *Operator) ReadAllUsers() ([]users.User, error){
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadAllUsers()
@@ -105,8 +106,8 @@ func (o *Operator) UpdateUser(user *users.User) error {
 		return InvalidParameterError
 	}
 
-	if ! o.dev.RelationToUser(user).Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("user/%d", user.UserId), Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().UpdateUser(user)
@@ -114,8 +115,8 @@ func (o *Operator) UpdateUser(user *users.User) error {
 
 // Attempts to delete a user as the given device.
 func (o *Operator) DeleteUser(id int64) error {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().DeleteUser(id)
@@ -123,8 +124,8 @@ func (o *Operator) DeleteUser(id int64) error {
 
 // Attempts to create a phone carrier as the given device
 func (o *Operator) CreatePhoneCarrier(name, emailDomain string) error {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().CreatePhoneCarrier(name, emailDomain)
@@ -132,8 +133,8 @@ func (o *Operator) CreatePhoneCarrier(name, emailDomain string) error {
 
 // ReadPhoneCarrierByIdAs attempts to select a phone carrier from the database given its ID
 func (o *Operator) ReadPhoneCarrierById(Id int64) (*users.PhoneCarrier, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ENABLED) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Read); err != nil {
+		return nil, err
 	}
 
 	// currently no permissions needed for this
@@ -142,8 +143,8 @@ func (o *Operator) ReadPhoneCarrierById(Id int64) (*users.PhoneCarrier, error) {
 
 // Attempts to read phone carriers as the given device
 func (o *Operator) ReadAllPhoneCarriers() ([]users.PhoneCarrier, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ENABLED) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Read); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadAllPhoneCarriers()
@@ -156,8 +157,8 @@ func (o *Operator) UpdatePhoneCarrier(carrier *users.PhoneCarrier) error {
 		return InvalidParameterError
 	}
 
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().UpdatePhoneCarrier(carrier)
@@ -165,8 +166,8 @@ func (o *Operator) UpdatePhoneCarrier(carrier *users.PhoneCarrier) error {
 
 // Attempts to delete the phone carrier as the given device
 func (o *Operator) DeletePhoneCarrier(carrierId int64) error {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().DeletePhoneCarrier(carrierId)
@@ -177,24 +178,24 @@ func (o *Operator) CreateDevice(Name string, Owner *users.User) error {
 		return InvalidParameterError
 	}
 
-	if ! o.dev.RelationToUser(Owner).Gte(users.USER) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("user/%d", Owner.UserId), Write); err != nil {
+		return err
 	}
 
 	return o.GetDatabase().CreateDevice(Name, Owner.UserId)
 }
 
 func (o *Operator) ReadDevicesForUser(u *users.User) ([]users.Device, error) {
-	if ! o.dev.RelationToUser(u).Gte(users.FAMILY) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("user/%d", u.UserId), Read); err != nil {
+		return nil, err
 	}
 
 	return o.GetDatabase().ReadDevicesForUserId(u.UserId)
 }
 
 func (o *Operator) ReadDeviceByApiKey(Key string) (*users.Device, error) {
-	if ! o.dev.GeneralPermissions().Gte(users.ROOT) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize("", Admin); err != nil {
+		return nil, err
 	}
 
 	return o.db.ReadDeviceByApiKey(Key)
@@ -205,8 +206,8 @@ func (o *Operator) UpdateDevice(update *users.Device) error {
 		return InvalidParameterError
 	}
 
-	if ! o.dev.RelationToDevice(update).Gte(users.DEVICE) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("device/%d", update.DeviceId), Write); err != nil {
+		return err
 	}
 
 	return o.db.UpdateDevice(update)
@@ -217,8 +218,8 @@ func (o *Operator) DeleteDevice(device *users.Device) error {
 		return InvalidParameterError
 	}
 
-	if ! o.dev.RelationToDevice(device).Gte(users.USER) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("device/%d", device.DeviceId), Admin); err != nil {
+		return err
 	}
 
 	return o.db.DeleteDevice(device.DeviceId)
@@ -229,16 +230,16 @@ func (o *Operator) CreateStream(Name, Type string, owner *users.Device) (error)
 		return InvalidParameterError
 	}
 
-	if ! o.dev.RelationToDevice(owner).Gte(users.USER) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("device/%d", owner.DeviceId), Admin); err != nil {
+		return err
 	}
 
 	return o.db.CreateStream(Name, Type, owner.DeviceId)
 }
 
 func (o *Operator) ReadStreamsByDevice(operand *users.Device) ([]users.Stream, error) {
-	if ! o.dev.RelationToDevice(operand).Gte(users.FAMILY) {
-		return nil, PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("device/%d", operand.DeviceId), Read); err != nil {
+		return nil, err
 	}
 
 	return o.db.ReadStreamsByDevice(operand.DeviceId)
@@ -246,16 +247,16 @@ func (o *Operator) ReadStreamsByDevice(operand *users.Device) ([]users.Stream, e
 
 func (o *Operator) UpdateStream(d *users.Device, stream *users.Stream) error {
 
-	if ! o.dev.RelationToStream(stream, d).Gte(users.USER) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("stream/%d", stream.StreamId), Write); err != nil {
+		return err
 	}
 
 	return o.db.UpdateStream(stream)
 }
 
 func (o *Operator) DeleteStream(d *users.Device, s *users.Stream) error {
-	if ! o.dev.RelationToStream(s, d).Gte(users.USER) {
-		return PERMISSION_ERROR
+	if err := o.authorize(fmt.Sprintf("stream/%d", s.StreamId), Write); err != nil {
+		return err
 	}
 
 	return o.db.DeleteStream(s.StreamId)
@@ -264,61 +265,8 @@ func (o *Operator) DeleteStream(d *users.Device, s *users.Stream) error {
 /**
 // Returns a request environment for performing a specific query.
 func (o *Operator) GetRequestEnvironment(path string) (ore *OperatorRequestEnv, error) {
-	u, d, s, err := ResolvePath(path)
+	nodes, err := o.Resolve(path, ResolveOptions{})
 
-	return &OperatorRequestEnv{o.db, o.dev, u, d, s}, err
+	return &OperatorRequestEnv{o.db, o.dev, nodes[0].User, nodes[0].Device, nodes[0].Stream}, err
 }
 **/
-
-/**
-Converts a path like user/device/stream into the literal user, device and stream
-
-The path may only fill from the left, e.g. "user//" meaning it will only return
-the user and nil for the others. Otherwise, the path may fill from the right,
-e.g. "/devicename/stream" in which case the user is implicitly the user belonging
-to the operator's device.
-
-**/
-func (o *Operator) ResolvePath(path string) (user *users.User, device *users.Device, stream *users.Stream, err error) {
-	err = nil
-
-	pathsplit := strings.Split(path, "/")
-	if len(pathsplit) != 3 {
-		return nil, nil, nil, INVALID_PATH_ERROR
-	}
-
-	uname := pathsplit[0]
-	dname := pathsplit[1]
-	sname := pathsplit[2]
-
-	// Parse the user
-	if uname == "" {
-		user, err = o.ReadUserById(o.GetDevice().UserId)
-
-		if err != nil {
-			return user, device, stream, err
-		}
-	} else {
-		user, err = o.ReadUserById(o.GetDevice().UserId)
-
-		if err != nil {
-			return user, device, stream, err
-		}
-	}
-
-	// Parse the device
-	if dname == "" {
-		device = o.GetDevice()
-	} else {
-		device, err := o.db.ReadDeviceForUserByName(user.UserId, dname)
-		if err != nil {
-			return user, device, stream, err
-		}
-	}
-
-	if sname != "" {
-		stream, err = o.db.ReadStreamByDeviceIdAndName(device.DeviceId, sname)
-	}
-
-	return user, device, stream, err
-}
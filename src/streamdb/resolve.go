@@ -0,0 +1,274 @@
+package streamdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"streamdb/users"
+)
+
+// ErrEmptyPath is returned by Resolve/Walk when path is the empty string.
+var ErrEmptyPath = errors.New("An empty path was given to Resolve")
+
+// ResolveOptions configures how Operator.Resolve/Walk expands a path.
+type ResolveOptions struct {
+	// AllowGlobs permits a "*" device or stream segment to expand to every
+	// device/stream at that level, instead of being matched literally.
+	AllowGlobs bool
+}
+
+// ResolvedNode is one user/device/stream triple produced by Resolve, along
+// with the operations the calling operator is allowed to perform on it -
+// computed once, so downstream CRUD calls don't need to re-check.
+type ResolvedNode struct {
+	User        *users.User
+	Device      *users.Device
+	Stream      *users.Stream
+	Permissions []Op
+}
+
+// Resolve expands path into every user/device/stream node it refers to.
+// path is one of:
+//
+//	user/device/stream   - fully qualified
+//	user/device          - just the device, Stream is nil
+//	user//               - just the user, Device and Stream are nil
+//	//device/stream       - device/stream belonging to the caller's own user
+//	user/*/stream        - glob over every device of user (opts.AllowGlobs)
+//	user/device/*        - glob over every stream of device (opts.AllowGlobs)
+//
+// Every node returned has already passed an authorize(path, Resolve) check,
+// so o.dev is at least allowed to see it - but that's not the same as being
+// allowed to act on it. Check ResolvedNode.Permissions, or use
+// authorize/the existing CRUD methods, before acting on a node.
+func (o *Operator) Resolve(path string, opts ResolveOptions) ([]ResolvedNode, error) {
+	var nodes []ResolvedNode
+	err := o.Walk(path, opts, func(n ResolvedNode) error {
+		nodes = append(nodes, n)
+		return nil
+	})
+	return nodes, err
+}
+
+// Walk is Resolve without materializing the full slice - fn is called once
+// per resolved node, and the walk stops (returning fn's error) as soon as fn
+// returns a non-nil error.
+func (o *Operator) Walk(path string, opts ResolveOptions, fn func(ResolvedNode) error) error {
+	if path == "" {
+		return ErrEmptyPath
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return INVALID_PATH_ERROR
+	}
+
+	uname := parts[0]
+	dname := parts[1]
+	sname := ""
+	if len(parts) == 3 {
+		sname = parts[2]
+	}
+
+	var u *users.User
+	var err error
+	if uname == "" {
+		u, err = o.db.ReadUserById(o.GetDevice().UserId)
+	} else {
+		u, err = o.db.ReadUserByName(uname)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := o.authorizeNode(u, nil, nil, Resolve); err != nil {
+		return err
+	}
+
+	if dname == "" && sname == "" {
+		return fn(o.makeNode(u, nil, nil))
+	}
+
+	devices, err := o.resolveDevices(u, dname, opts)
+	if err != nil {
+		return err
+	}
+
+	if sname == "" {
+		for i := range devices {
+			if err := fn(o.makeNode(u, &devices[i], nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := range devices {
+		streams, err := o.resolveStreams(&devices[i], sname, opts)
+		if err != nil {
+			return err
+		}
+		for j := range streams {
+			if err := fn(o.makeNode(u, &devices[i], &streams[j])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveDevices expands a single device path segment. An empty segment
+// defaults to the operator's own device - it is only reached when sname is
+// non-empty (see Walk), so "user//" never ends up here.
+//
+// Every device resolveDevices returns is one o is actually authorized to
+// Resolve: a named device that fails the check is a hard error, while a "*"
+// glob silently drops anything o isn't authorized for, the same way a
+// directory listing omits entries you can't see rather than failing the
+// whole listing. A findACL failure that isn't a plain "not authorized" (a
+// tampered ACL, a read error) still fails the whole call either way.
+func (o *Operator) resolveDevices(u *users.User, dname string, opts ResolveOptions) ([]users.Device, error) {
+	if dname == "" {
+		d := o.GetDevice()
+		if err := o.authorizeNode(nil, d, nil, Resolve); err != nil {
+			return nil, err
+		}
+		return []users.Device{*d}, nil
+	}
+	if dname == "*" {
+		if !opts.AllowGlobs {
+			return nil, INVALID_PATH_ERROR
+		}
+		all, err := o.db.ReadDevicesForUserId(u.UserId)
+		if err != nil {
+			return nil, err
+		}
+		return o.filterDevicesByResolve(all)
+	}
+
+	d, err := o.db.ReadDeviceForUserByName(u.UserId, dname)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.authorizeNode(nil, d, nil, Resolve); err != nil {
+		return nil, err
+	}
+	return []users.Device{*d}, nil
+}
+
+// filterDevicesByResolve keeps only the devices of devices that o is
+// authorized to Resolve, dropping (not failing on) the ones it plainly
+// isn't. Any other error - a tampered ACL, a read failure - fails the whole
+// call instead of silently vanishing from the listing.
+func (o *Operator) filterDevicesByResolve(devices []users.Device) ([]users.Device, error) {
+	allowed := make([]users.Device, 0, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		switch err := o.authorizeNode(nil, d, nil, Resolve); err {
+		case nil:
+			allowed = append(allowed, *d)
+		case PERMISSION_ERROR:
+		default:
+			return nil, err
+		}
+	}
+	return allowed, nil
+}
+
+// resolveStreams expands a single stream path segment. See resolveDevices
+// for how a named segment vs. a "*" glob are authorized differently.
+func (o *Operator) resolveStreams(d *users.Device, sname string, opts ResolveOptions) ([]users.Stream, error) {
+	if sname == "*" {
+		if !opts.AllowGlobs {
+			return nil, INVALID_PATH_ERROR
+		}
+		all, err := o.db.ReadStreamsByDevice(d.DeviceId)
+		if err != nil {
+			return nil, err
+		}
+		return o.filterStreamsByResolve(d, all)
+	}
+
+	s, err := o.db.ReadStreamByDeviceIdAndName(d.DeviceId, sname)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.authorizeNode(nil, d, s, Resolve); err != nil {
+		return nil, err
+	}
+	return []users.Stream{*s}, nil
+}
+
+// filterStreamsByResolve keeps only the streams of streams that o is
+// authorized to Resolve - see filterDevicesByResolve for the deny-vs-error
+// distinction.
+func (o *Operator) filterStreamsByResolve(d *users.Device, streams []users.Stream) ([]users.Stream, error) {
+	allowed := make([]users.Stream, 0, len(streams))
+	for i := range streams {
+		s := &streams[i]
+		switch err := o.authorizeNode(nil, d, s, Resolve); err {
+		case nil:
+			allowed = append(allowed, *s)
+		case PERMISSION_ERROR:
+		default:
+			return nil, err
+		}
+	}
+	return allowed, nil
+}
+
+// makeNode builds a ResolvedNode, computing o's effective permission on the
+// most specific resource present (stream, else device, else user).
+func (o *Operator) makeNode(u *users.User, d *users.Device, s *users.Stream) ResolvedNode {
+	path, tag := o.nodePathAndTag(u, d, s)
+
+	perms, err := o.effectivePermissions(path, tag)
+	if err != nil {
+		perms = nil
+	}
+
+	return ResolvedNode{User: u, Device: d, Stream: s, Permissions: perms}
+}
+
+// authorizeNode is authorize for a user/device/stream already in hand - it
+// reuses nodePathAndTag instead of authorize's relationTag, which would
+// otherwise re-fetch the very entity the caller is already holding from the
+// DB. Exactly one of u/d/s should be the node being checked, per
+// nodePathAndTag.
+func (o *Operator) authorizeNode(u *users.User, d *users.Device, s *users.Stream, op Op) error {
+	path, tag := o.nodePathAndTag(u, d, s)
+	return o.authorizeTag(path, tag, op)
+}
+
+func (o *Operator) nodePathAndTag(u *users.User, d *users.Device, s *users.Stream) (path, tag string) {
+	switch {
+	case s != nil:
+		return fmt.Sprintf("stream/%d", s.StreamId), tagForLevel(o.dev.RelationToStream(s, d))
+	case d != nil:
+		return fmt.Sprintf("device/%d", d.DeviceId), tagForLevel(o.dev.RelationToDevice(d))
+	default:
+		return fmt.Sprintf("user/%d", u.UserId), tagForLevel(o.dev.RelationToUser(u))
+	}
+}
+
+// effectivePermissions returns the ops the ACL governing path grants to tag
+// and everything below it in privilege.
+func (o *Operator) effectivePermissions(path, tag string) ([]Op, error) {
+	acl, err := o.findACL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[Op]bool)
+	var granted []Op
+	for _, t := range qualifyingTags(tag) {
+		for _, op := range acl[t] {
+			if !seen[op] {
+				seen[op] = true
+				granted = append(granted, op)
+			}
+		}
+	}
+	return granted, nil
+}